@@ -0,0 +1,172 @@
+package dnscrypt
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// certRefreshMargin bounds how long before TSEnd a Client proactively
+// refreshes its certificate. The margin is randomized within this range so
+// that many clients of the same server don't all refresh at once.
+const certRefreshMargin = 5 * time.Minute
+
+// Client is a stateful DNSCrypt client for a single server. It caches the
+// server's certificate across queries, refreshing it only once it is close
+// to expiry, and reuses a single ephemeral keypair for that server instead
+// of generating a new one per query. A Client is safe for concurrent use.
+type Client struct {
+	ServerAddress string
+	ProviderName  string
+	ProviderKey   []byte
+	Transport     Transport
+
+	// OnCertRefresh, if set, is called after every successful certificate
+	// refresh with the newly validated certificate.
+	OnCertRefresh func(SignedBincertFields)
+	// Logger, if set, receives diagnostic messages (cert refreshes, retries).
+	Logger *log.Logger
+
+	mu          sync.RWMutex
+	cert        SignedBincertFields
+	haveCert    bool
+	nextRefresh time.Time
+	clientPK    *[32]byte
+	clientSK    *[32]byte
+}
+
+// NewClient creates a Client for the given server. The certificate is
+// fetched lazily, on the first call to Exchange.
+func NewClient(serverAddress, providerName string, providerKey []byte) *Client {
+	return &Client{
+		ServerAddress: serverAddress,
+		ProviderName:  providerName,
+		ProviderKey:   providerKey,
+		Transport:     TransportAuto,
+	}
+}
+
+// NewClientFromStamp creates a Client from a DNSCrypt "sdns://" stamp (see
+// NewStampFromString), so callers don't need to hand-carry the server
+// address, provider name, and provider key separately.
+func NewClientFromStamp(stampStr string) (*Client, error) {
+	stamp, err := NewStampFromString(stampStr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(stamp.ServerAddr, stamp.ProviderName, stamp.ServerPk[:]), nil
+}
+
+func (c *Client) logf(format string, args ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Printf(format, args...)
+	}
+}
+
+// refreshCert fetches and validates a new certificate, and generates a fresh
+// ephemeral keypair to go with it.
+func (c *Client) refreshCert() error {
+	cert, err := GetValidCert(c.ServerAddress, c.ProviderName, c.ProviderKey)
+	if err != nil {
+		return err
+	}
+	clientPK, clientSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	nextRefresh := jitteredRefreshTime(cert.TSEnd)
+
+	c.mu.Lock()
+	c.cert = cert
+	c.haveCert = true
+	c.nextRefresh = nextRefresh
+	c.clientPK = clientPK
+	c.clientSK = clientSK
+	c.mu.Unlock()
+
+	c.logf("dnscrypt: refreshed certificate for %s, next refresh at %s", c.ProviderName, nextRefresh)
+	if c.OnCertRefresh != nil {
+		c.OnCertRefresh(cert)
+	}
+	return nil
+}
+
+// jitteredRefreshTime picks a refresh time somewhat before a certificate's
+// TSEnd, randomized so concurrent clients don't all refresh in lockstep.
+func jitteredRefreshTime(tsEnd uint32) time.Time {
+	jitter := time.Duration(mrand.Int63n(int64(certRefreshMargin)))
+	return time.Unix(int64(tsEnd), 0).Add(-jitter)
+}
+
+// snapshot returns the currently cached certificate and keypair as a single,
+// internally-consistent read, so a concurrent refreshCert() can never hand
+// back a clientPK from one cert generation paired with the clientSK of
+// another.
+func (c *Client) snapshot() (SignedBincertFields, *[32]byte, *[32]byte) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, c.clientPK, c.clientSK
+}
+
+// ensureCert returns the currently cached certificate and keypair, refreshing
+// them first if there is none yet or the cached one is due for renewal.
+func (c *Client) ensureCert() (SignedBincertFields, *[32]byte, *[32]byte, error) {
+	c.mu.RLock()
+	haveCert := c.haveCert
+	stale := !haveCert || !time.Now().Before(c.nextRefresh)
+	c.mu.RUnlock()
+
+	if !stale {
+		cert, clientPK, clientSK := c.snapshot()
+		return cert, clientPK, clientSK, nil
+	}
+
+	if err := c.refreshCert(); err != nil {
+		if haveCert {
+			// keep serving the last known-good certificate if a refresh fails
+			cert, clientPK, clientSK := c.snapshot()
+			return cert, clientPK, clientSK, nil
+		}
+		return SignedBincertFields{}, nil, nil, err
+	}
+	cert, clientPK, clientSK := c.snapshot()
+	return cert, clientPK, clientSK, nil
+}
+
+// Exchange sends msg to the server and returns its response, transparently
+// refreshing the certificate when it is expired and retrying once on a
+// decryption failure, in case the server rotated its certificate between the
+// refresh and this query.
+func (c *Client) Exchange(msg dns.Msg) (dns.Msg, error) {
+	cert, clientPK, clientSK, err := c.ensureCert()
+	if err != nil {
+		return dns.Msg{}, err
+	}
+
+	dnscryptQuery, err := encryptQueryWithKeypair(msg, cert, clientPK, clientSK)
+	if err != nil {
+		return dns.Msg{}, err
+	}
+	resp, err := deliver(c.ServerAddress, c.Transport, dnscryptQuery, cert, clientSK)
+	if errors.Is(err, ErrDecryptionFailed) {
+		c.logf("dnscrypt: decryption failed for %s, refreshing certificate and retrying once", c.ProviderName)
+		if err := c.refreshCert(); err != nil {
+			return dns.Msg{}, err
+		}
+		cert, clientPK, clientSK = c.snapshot()
+		dnscryptQuery, err := encryptQueryWithKeypair(msg, cert, clientPK, clientSK)
+		if err != nil {
+			return dns.Msg{}, err
+		}
+		resp, err = deliver(c.ServerAddress, c.Transport, dnscryptQuery, cert, clientSK)
+		return resp, err
+	}
+	return resp, err
+}
@@ -32,6 +32,29 @@ func removePadding(padded []byte) ([]byte, error) {
 	return unpadded[:len(unpadded)-1], nil
 }
 
+// packTXT escapes a raw byte slice the way miekg/dns's own TXT packing
+// (packTxtString) unescapes it when a dns.Msg is packed to wire format: only
+// `\\`, `\"`, and `\DDD` are recognized there, so those are the only escapes
+// packTXT may emit. Anything else after a backslash (e.g. `\n`, `\r`) is
+// copied through literally by packTxtString rather than decoded, which would
+// silently corrupt the bytes we're trying to round-trip.
+func packTXT(raw []byte) []byte {
+	packed := make([]byte, 0, len(raw))
+	for _, b := range raw {
+		switch {
+		case b == '\\':
+			packed = append(packed, '\\', '\\')
+		case b == '"':
+			packed = append(packed, '\\', '"')
+		case b < 32 || b > 127:
+			packed = append(packed, []byte(fmt.Sprintf("\\%03d", b))...)
+		default:
+			packed = append(packed, b)
+		}
+	}
+	return packed
+}
+
 // unpackTXT decodes TXT packing
 // from the miekg/dns docs:
 // > For TXT character strings, tabs, carriage returns and line feeds will be converted to \t, \r and \n respectively.
@@ -68,6 +91,10 @@ func unpackTXT(txt []byte) ([]byte, error) {
 					unpackedTXT[i] = '\t'
 				case 'r':
 					unpackedTXT[i] = '\r'
+				case '\\':
+					unpackedTXT[i] = '\\'
+				case '"':
+					unpackedTXT[i] = '"'
 				default:
 					j++
 					return unpackedTXT, fmt.Errorf("%s", "Invalid slash escaped character found!")
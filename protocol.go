@@ -1,15 +1,17 @@
 package dnscrypt
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"io"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/nacl/box"
 )
@@ -18,8 +20,114 @@ var (
 	certificateMagic = "DNSC"
 	resolverMagic    = [8]byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
 	dnsMaxSizeUDP    = 65536 - 20 - 8
+	// relayMagic ("rlfg@vl9") prefixes a relayed query so the relay knows
+	// where to forward it; see the Anonymized DNSCrypt specification.
+	relayMagic = [8]byte{0x72, 0x6c, 0x66, 0x67, 0x40, 0x76, 0x6c, 0x39}
 )
 
+// ErrDecryptionFailed is returned when a DNSCrypt response could not be
+// authenticated under the keys negotiated from the server's certificate —
+// for instance because the server rotated its certificate between the
+// request and the response.
+var ErrDecryptionFailed = errors.New("Could not decrypt response")
+
+// Transport selects how ExchangeEncrypted exchanges its query with the server.
+type Transport int
+
+const (
+	// TransportUDP always uses UDP, as the original implementation did.
+	TransportUDP Transport = iota
+	// TransportTCP always uses TCP, length-prefixed per spec §9.
+	TransportTCP
+	// TransportAuto starts with UDP and falls back to TCP when the reply is
+	// truncated or the UDP datagram is silently dropped.
+	TransportAuto
+)
+
+// udpReadTimeout bounds how long TransportAuto waits on UDP before treating
+// the datagram as dropped and retrying over TCP.
+const udpReadTimeout = 2 * time.Second
+
+// roundTrip sends payload over conn and returns the raw reply, applying the
+// 2-byte big-endian length prefix TCP framing requires (spec §9). Future
+// transports (e.g. DoH-tunnelled) can be added here without touching callers.
+func roundTrip(conn net.Conn, transport Transport, payload []byte) ([]byte, error) {
+	if transport == TransportTCP {
+		var lengthPrefix [2]byte
+		binary.BigEndian.PutUint16(lengthPrefix[:], uint16(len(payload)))
+		if _, err := conn.Write(lengthPrefix[:]); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(payload); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, lengthPrefix[:]); err != nil {
+			return nil, err
+		}
+		reply := make([]byte, binary.BigEndian.Uint16(lengthPrefix[:]))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	}
+
+	if _, err := conn.Write(payload); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, dnsMaxSizeUDP)
+	n, err := conn.Read(reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply[:n], nil
+}
+
+// sharedKey derives the shared key for a given keypair the same way nacl/box
+// does internally: a curve25519 scalar multiplication followed by HSalsa20.
+// XChacha20Poly1305 reuses this derivation since the spec defines it as the
+// same key agreement as XSalsa20Poly1305, only the AEAD differs.
+func sharedKey(peersPublicKey, privateKey *[32]byte) [32]byte {
+	var key [32]byte
+	box.Precompute(&key, peersPublicKey, privateKey)
+	return key
+}
+
+// seal encrypts and authenticates plaintext under the construction negotiated
+// by the server's certificate.
+func seal(construction CryptoConstruction, plaintext []byte, nonce *[24]byte, peersPublicKey, privateKey *[32]byte) ([]byte, error) {
+	switch construction {
+	case XChacha20Poly1305:
+		key := sharedKey(peersPublicKey, privateKey)
+		aead, err := chacha20poly1305.NewX(key[:])
+		if err != nil {
+			return nil, err
+		}
+		return aead.Seal(nil, nonce[:], plaintext, nil), nil
+	default:
+		return box.Seal(nil, plaintext, nonce, peersPublicKey, privateKey), nil
+	}
+}
+
+// open decrypts and verifies ciphertext under the construction negotiated by
+// the server's certificate.
+func open(construction CryptoConstruction, ciphertext []byte, nonce *[24]byte, peersPublicKey, privateKey *[32]byte) ([]byte, error) {
+	switch construction {
+	case XChacha20Poly1305:
+		key := sharedKey(peersPublicKey, privateKey)
+		aead, err := chacha20poly1305.NewX(key[:])
+		if err != nil {
+			return nil, err
+		}
+		return aead.Open(nil, nonce[:], ciphertext, nil)
+	default:
+		plaintext, ok := box.Open(nil, ciphertext, nonce, peersPublicKey, privateKey)
+		if !ok {
+			return nil, ErrDecryptionFailed
+		}
+		return plaintext, nil
+	}
+}
+
 // GetValidCert retrieves th DNSC certificate for a server
 // it validates the certificate and returns the certificates details
 // iff it is valid. Otherwise an error is returned.
@@ -40,11 +148,12 @@ func GetValidCert(serverAddress string, providerName string, providerKey []byte)
 	for _, answer := range in.Answer {
 		t, ok := answer.(*dns.TXT)
 		if !ok {
-			return SignedBincertFields{}, errors.New("First answer not a TXT record")
+			// not every answer need be our certificate TXT record; keep looking
+			continue
 		}
 
 		// check for magic Bytes
-		if t.Txt[0][0:5] == certificateMagic {
+		if len(t.Txt[0]) < len(certificateMagic) || t.Txt[0][0:len(certificateMagic)] != certificateMagic {
 			return SignedBincertFields{}, errors.New("TXT record is not a DNSC certificate")
 		}
 
@@ -65,11 +174,15 @@ func GetValidCert(serverAddress string, providerName string, providerKey []byte)
 		// Version indicates which crypto construction to use
 		// For X25519-XSalsa20Poly1305, <es-version> must be 0x00 0x01.
 		// For X25519-XChacha20Poly1305, <es-version> must be 0x00 0x02.
-		if bincert.VersionMajor != 0x01 {
+		construction := CryptoConstruction(bincert.VersionMajor)
+		if construction != XSalsa20Poly1305 && construction != XChacha20Poly1305 {
 			// we do not support this version, look further
 			bincert = nil
 			continue
 		}
+		// found a supported certificate; stop so a later, unsupported TXT
+		// answer in the same response can't overwrite it
+		break
 	}
 	// have we found a supported certificate?
 	if bincert == nil {
@@ -84,11 +197,19 @@ func GetValidCert(serverAddress string, providerName string, providerKey []byte)
 
 	// parse inner structure to get pubkey, validity dates, etc.
 	buf := bytes.NewReader(bincert.SignedData[:])
-	bincertFields := SignedBincertFields{}
-	err = binary.Read(buf, binary.BigEndian, &bincertFields)
+	wireFields := signedBincertFieldsWire{}
+	err = binary.Read(buf, binary.BigEndian, &wireFields)
 	if err != nil {
 		return SignedBincertFields{}, err
 	}
+	bincertFields := SignedBincertFields{
+		ServerPublicKey: wireFields.ServerPublicKey,
+		MagicQuery:      wireFields.MagicQuery,
+		Serial:          wireFields.Serial,
+		TSBegin:         wireFields.TSBegin,
+		TSEnd:           wireFields.TSEnd,
+		Construction:    CryptoConstruction(bincert.VersionMajor),
+	}
 
 	// is the certificate valid?
 	// get unsigned timestamp while avoiding uint wrap-arounds
@@ -109,64 +230,176 @@ func GetValidCert(serverAddress string, providerName string, providerKey []byte)
 	return bincertFields, nil
 }
 
-// ExchangeEncrypted exchanges encrypted dns query and returns the response message.
-// It needs the specifics of a DNSC server as obtained by calling GetValidCert()
-func ExchangeEncrypted(serverAddress string, msg dns.Msg, bincertFields SignedBincertFields) (dns.Msg, error) {
-	// TODO: the following will be wrapped in a lookUP() function
+// encryptQuery packs and seals msg for bincertFields' server, returning the
+// wire-ready DNSCrypt query (header + encrypted payload) and the ephemeral
+// client secret key needed to decrypt the matching response.
+func encryptQuery(msg dns.Msg, bincertFields SignedBincertFields) ([]byte, *[32]byte, error) {
+	clientPK, clientSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	dnscryptQuery, err := encryptQueryWithKeypair(msg, bincertFields, clientPK, clientSK)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dnscryptQuery, clientSK, nil
+}
+
+// encryptQueryWithKeypair is like encryptQuery but uses a caller-supplied
+// client keypair instead of generating a fresh one, so long-lived callers
+// (see Client) can reuse the same ephemeral keypair across queries to a
+// server instead of paying a key generation on every exchange.
+func encryptQueryWithKeypair(msg dns.Msg, bincertFields SignedBincertFields, clientPK, clientSK *[32]byte) ([]byte, error) {
 	queryHeader := dnsCryptQueryHeader{
-		ClientMagic: bincertFields.MagicQuery,
+		ClientMagic:     bincertFields.MagicQuery,
+		ClientPublicKey: *clientPK,
 	}
 	// Client Nonce
 	// The specification says half of the nonce should be zeros => ClientNonce[:12]
 	if _, err := rand.Read(queryHeader.ClientNonce[:12]); err != nil {
-		return dns.Msg{}, err
+		return nil, err
 	}
-	// KeyPair
-	clientPK, clientSK, err := box.GenerateKey(rand.Reader)
-	if err != nil {
-		return dns.Msg{}, err
-	}
-	queryHeader.ClientPublicKey = *clientPK
 
 	serializedDNSQuery, err := msg.PackBuffer(nil)
 	if err != nil {
-		return dns.Msg{}, err
+		return nil, err
 	}
 
 	// add padding
 	serializedDNSQuery, err = addPadding(serializedDNSQuery)
 	if err != nil {
-		return dns.Msg{}, err
+		return nil, err
 	}
 
 	// build nonce: <nonce> := <client_nonce><12 zeros>
 	var nonce [24]byte
 	copy(nonce[:], append(queryHeader.ClientNonce[:12], []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}...))
-	// we use nacl.box authenticetd encryption for the query
-	encryptedQuery := box.Seal(nil, serializedDNSQuery, &nonce, &bincertFields.ServerPublicKey, clientSK)
+	// seal the query with the construction negotiated by the certificate
+	encryptedQuery, err := seal(bincertFields.Construction, serializedDNSQuery, &nonce, &bincertFields.ServerPublicKey, clientSK)
+	if err != nil {
+		return nil, err
+	}
 
 	// serialize header and encrypted query to buffer
 	dnscryptQuery := new(bytes.Buffer)
 	binary.Write(dnscryptQuery, binary.BigEndian, queryHeader)
 	binary.Write(dnscryptQuery, binary.BigEndian, encryptedQuery)
 
-	conn, err := net.Dial("udp", serverAddress)
+	return dnscryptQuery.Bytes(), nil
+}
+
+// deliver sends an already-encrypted DNSCrypt query to addr, honouring
+// Transport's UDP/TCP/Auto semantics, and decrypts the response.
+func deliver(addr string, transport Transport, payload []byte, bincertFields SignedBincertFields, clientSK *[32]byte) (dns.Msg, error) {
+	firstTransport := transport
+	if firstTransport == TransportAuto {
+		firstTransport = TransportUDP
+	}
+
+	// Auto's UDP-first attempt needs a bounded read so a dropped datagram
+	// falls back to TCP instead of hanging forever; an explicit TransportUDP
+	// call gets no such deadline, matching the original implementation.
+	responseMsg, err := exchangeOverTransport(addr, firstTransport, transport == TransportAuto, payload, bincertFields, clientSK)
+	if transport == TransportAuto {
+		netErr, timedOut := err.(net.Error)
+		if (err == nil && responseMsg.Truncated) || (timedOut && netErr.Timeout()) {
+			responseMsg, err = exchangeOverTransport(addr, TransportTCP, false, payload, bincertFields, clientSK)
+		}
+	}
+	return responseMsg, err
+}
+
+// ExchangeEncrypted exchanges encrypted dns query and returns the response message.
+// It needs the specifics of a DNSC server as obtained by calling GetValidCert().
+// transport selects UDP, TCP, or automatic UDP-with-TCP-fallback (see Transport).
+func ExchangeEncrypted(serverAddress string, msg dns.Msg, bincertFields SignedBincertFields, transport Transport) (dns.Msg, error) {
+	dnscryptQuery, clientSK, err := encryptQuery(msg, bincertFields)
 	if err != nil {
 		return dns.Msg{}, err
 	}
-	// send query
-	binary.Write(conn, binary.BigEndian, dnscryptQuery.Bytes())
+	return deliver(serverAddress, transport, dnscryptQuery, bincertFields, clientSK)
+}
 
-	///////////////////////////////////////////////////////////////////////////////////////
-	// DONE SENDING
-	///////////////////////////////////////////////////////////////////////////////////////
+// wrapForRelay prefixes an encrypted DNSCrypt query with the Anonymized
+// DNSCrypt relay header: the 8-byte relayMagic followed by the target
+// resolver's IP (IPv4-mapped into 16 bytes when needed) and 2-byte port.
+func wrapForRelay(targetAddr string, dnscryptQuery []byte) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("Relay target address is not an IP address")
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return nil, errors.New("Relay target address could not be converted to a 16-byte IP")
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	relayedQuery := make([]byte, 0, 8+16+2+len(dnscryptQuery))
+	relayedQuery = append(relayedQuery, relayMagic[:]...)
+	relayedQuery = append(relayedQuery, ip16...)
+	relayedQuery = binary.BigEndian.AppendUint16(relayedQuery, uint16(port))
+	relayedQuery = append(relayedQuery, dnscryptQuery...)
+	return relayedQuery, nil
+}
+
+// ExchangeEncryptedVia exchanges an encrypted dns query with targetAddr
+// through an Anonymized DNSCrypt relay at relayAddr. The query is still
+// encrypted and authenticated for the target resolver, as identified by
+// bincertFields (obtained from targetAddr via GetValidCert) — the relay only
+// forwards the already-sealed bytes on, so the response is handled exactly
+// as it would be for a direct exchange.
+func ExchangeEncryptedVia(relayAddr string, targetAddr string, msg dns.Msg, bincertFields SignedBincertFields, transport Transport) (dns.Msg, error) {
+	dnscryptQuery, clientSK, err := encryptQuery(msg, bincertFields)
+	if err != nil {
+		return dns.Msg{}, err
+	}
+	relayedQuery, err := wrapForRelay(targetAddr, dnscryptQuery)
+	if err != nil {
+		return dns.Msg{}, err
+	}
+	return deliver(relayAddr, transport, relayedQuery, bincertFields, clientSK)
+}
 
-	// receive
-	p := make([]byte, dnsMaxSizeUDP)
-	n, err := bufio.NewReader(conn).Read(p)
+// exchangeOverTransport sends an already-encrypted DNSCrypt query over a
+// single transport and decrypts the reply. boundUDPRead requests the
+// udpReadTimeout deadline, used only for Auto's UDP-first attempt so a
+// dropped datagram can be detected and retried over TCP; an explicit
+// TransportUDP call passes false and blocks indefinitely, as the original
+// implementation did.
+func exchangeOverTransport(serverAddress string, transport Transport, boundUDPRead bool, dnscryptQuery []byte, bincertFields SignedBincertFields, clientSK *[32]byte) (dns.Msg, error) {
+	network := "udp"
+	if transport == TransportTCP {
+		network = "tcp"
+	}
+	conn, err := net.Dial(network, serverAddress)
 	if err != nil {
 		return dns.Msg{}, err
 	}
+	defer conn.Close()
+	if boundUDPRead {
+		if err := conn.SetReadDeadline(time.Now().Add(udpReadTimeout)); err != nil {
+			return dns.Msg{}, err
+		}
+	}
+
+	p, err := roundTrip(conn, transport, dnscryptQuery)
+	if err != nil {
+		return dns.Msg{}, err
+	}
+	if len(p) < 32 {
+		return dns.Msg{}, errors.New("Reply is shorter than a DNSCrypt response header")
+	}
+
+	///////////////////////////////////////////////////////////////////////////////////////
+	// DONE SENDING
+	///////////////////////////////////////////////////////////////////////////////////////
 
 	// parse response header
 	responseHeaderBytes := bytes.NewBuffer(p[:32])
@@ -182,13 +415,14 @@ func ExchangeEncrypted(serverAddress string, msg dns.Msg, bincertFields SignedBi
 	}
 
 	// encrypted reply
-	encryptedResponse := p[32:n]
+	encryptedResponse := p[32:]
 
 	// decrypt the reply with info from the header
+	var nonce [24]byte
 	copy(nonce[:], append(responseHeader.ClientNonce[:], responseHeader.ServerNonce[:]...))
-	dnsResponse, ok := box.Open(nil, encryptedResponse, &nonce, &bincertFields.ServerPublicKey, clientSK)
-	if !ok {
-		return dns.Msg{}, errors.New("Could not decrypt response")
+	dnsResponse, err := open(bincertFields.Construction, encryptedResponse, &nonce, &bincertFields.ServerPublicKey, clientSK)
+	if err != nil {
+		return dns.Msg{}, ErrDecryptionFailed
 	}
 
 	// strip padding from the decrypted dns response
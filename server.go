@@ -0,0 +1,452 @@
+package dnscrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// DefaultCertLifetime is the validity period a Server gives each certificate
+// it generates, if CertLifetime is left at its zero value.
+const DefaultCertLifetime = 24 * time.Hour
+
+// DefaultCertOverlap is how long before a certificate's expiry a Server
+// rotates in a new one, if CertOverlap is left at its zero value. Queries
+// signed under the outgoing certificate are still accepted until it expires.
+const DefaultCertOverlap = time.Hour
+
+// certEntry is a certificate a Server currently accepts queries under,
+// together with the X25519 secret key needed to decrypt them.
+type certEntry struct {
+	fields    SignedBincertFields
+	secretKey [32]byte
+	wireCert  []byte // the signedBincert, serialized, as served over TXT
+}
+
+// Server is a DNSCrypt responder. It mirrors dns.Server: it dispatches
+// decrypted queries to a user-supplied Handler and lets that handler reply
+// exactly as it would to a plain dns.Server, while this type takes care of
+// certificate rotation, publication, and the DNSCrypt wire format.
+type Server struct {
+	// ProviderName is this server's DNSCrypt provider name, e.g.
+	// "2.dnscrypt-cert.example.com.". Certificates are published as a TXT
+	// record under this name.
+	ProviderName string
+	// SigningKey signs every certificate this server publishes. Its public
+	// half is the providerPublicKey clients verify certificates against.
+	SigningKey ed25519.PrivateKey
+	// Handler dispatches decrypted queries, exactly like a dns.Server's.
+	Handler dns.Handler
+	// Construction is the AEAD construction new certificates negotiate.
+	// Defaults to XSalsa20Poly1305.
+	Construction CryptoConstruction
+	// CertLifetime is how long a freshly rotated certificate stays valid.
+	// Defaults to DefaultCertLifetime.
+	CertLifetime time.Duration
+	// CertOverlap is how long before expiry a new certificate is rotated
+	// in, during which both it and the outgoing certificate are accepted.
+	// Defaults to DefaultCertOverlap.
+	CertOverlap time.Duration
+
+	mu       sync.RWMutex
+	current  *certEntry
+	previous *certEntry
+
+	serial uint32
+
+	udpConn net.PacketConn
+	tcpLn   net.Listener
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (s *Server) certLifetime() time.Duration {
+	if s.CertLifetime <= 0 {
+		return DefaultCertLifetime
+	}
+	return s.CertLifetime
+}
+
+func (s *Server) certOverlap() time.Duration {
+	if s.CertOverlap <= 0 {
+		return DefaultCertOverlap
+	}
+	return s.CertOverlap
+}
+
+func (s *Server) construction() CryptoConstruction {
+	if s.Construction == 0 {
+		return XSalsa20Poly1305
+	}
+	return s.Construction
+}
+
+// rotateCert generates, signs, and publishes a new certificate, keeping the
+// previously current one around so in-flight clients aren't cut off.
+func (s *Server) rotateCert() error {
+	serverPK, serverSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	var magicQuery [8]byte
+	if _, err := rand.Read(magicQuery[:]); err != nil {
+		return err
+	}
+
+	now := uint32(time.Now().Unix())
+	var serialBytes [4]byte
+	binary.BigEndian.PutUint32(serialBytes[:], atomic.AddUint32(&s.serial, 1))
+
+	fields := SignedBincertFields{
+		ServerPublicKey: *serverPK,
+		MagicQuery:      magicQuery,
+		Serial:          serialBytes,
+		TSBegin:         now,
+		TSEnd:           now + uint32(s.certLifetime().Seconds()),
+		Construction:    s.construction(),
+	}
+
+	wireBuf := new(bytes.Buffer)
+	binary.Write(wireBuf, binary.BigEndian, signedBincertFieldsWire{
+		ServerPublicKey: fields.ServerPublicKey,
+		MagicQuery:      fields.MagicQuery,
+		Serial:          fields.Serial,
+		TSBegin:         fields.TSBegin,
+		TSEnd:           fields.TSEnd,
+	})
+	var signedData [52]byte
+	copy(signedData[:], wireBuf.Bytes())
+
+	bincert := signedBincert{
+		MagicCert:    [4]byte{'D', 'N', 'S', 'C'},
+		VersionMajor: uint16(fields.Construction),
+		SignedData:   signedData,
+	}
+	copy(bincert.Signature[:], ed25519.Sign(s.SigningKey, signedData[:]))
+
+	certBuf := new(bytes.Buffer)
+	binary.Write(certBuf, binary.BigEndian, bincert)
+
+	entry := &certEntry{fields: fields, wireCert: certBuf.Bytes()}
+	copy(entry.secretKey[:], serverSK[:])
+
+	s.mu.Lock()
+	s.previous = s.current
+	s.current = entry
+	s.mu.Unlock()
+	return nil
+}
+
+// entryForMagic returns the cert entry (current or, during overlap,
+// previous) whose MagicQuery matches a query's ClientMagic.
+func (s *Server) entryForMagic(magic [8]byte) (*certEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.current != nil && s.current.fields.MagicQuery == magic {
+		return s.current, true
+	}
+	if s.previous != nil && s.previous.fields.MagicQuery == magic && time.Now().Unix() <= int64(s.previous.fields.TSEnd) {
+		return s.previous, true
+	}
+	return nil, false
+}
+
+func (s *Server) currentEntry() *certEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// rotateCertLoop rotates the certificate once per (CertLifetime - CertOverlap)
+// until the server is closed.
+func (s *Server) rotateCertLoop() {
+	defer s.wg.Done()
+	interval := s.certLifetime() - s.certOverlap()
+	if interval <= 0 {
+		interval = s.certLifetime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+			// a failed rotation just means we keep serving the current
+			// certificate and try again on the next tick
+			_ = s.rotateCert()
+		}
+	}
+}
+
+// ListenAndServe publishes an initial certificate and serves DNSCrypt
+// queries on udpAddr (UDP) and tcpAddr (TCP, length-prefixed per spec §9)
+// until Close is called. Both listeners also answer the plain DNS TXT query
+// for ProviderName that clients use to fetch the certificate.
+func (s *Server) ListenAndServe(udpAddr, tcpAddr string) error {
+	if s.Handler == nil {
+		return errors.New("dnscrypt: Server.Handler must be set")
+	}
+	if err := s.rotateCert(); err != nil {
+		return err
+	}
+
+	udpConn, err := net.ListenPacket("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	tcpLn, err := net.Listen("tcp", tcpAddr)
+	if err != nil {
+		udpConn.Close()
+		return err
+	}
+
+	s.udpConn = udpConn
+	s.tcpLn = tcpLn
+	s.closeCh = make(chan struct{})
+
+	s.wg.Add(3)
+	go s.rotateCertLoop()
+	go s.serveUDP(udpConn)
+	go s.serveTCP(tcpLn)
+	s.wg.Wait()
+	return nil
+}
+
+// Close stops accepting new queries and waits for the serving goroutines to
+// return.
+func (s *Server) Close() error {
+	close(s.closeCh)
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	if s.tcpLn != nil {
+		s.tcpLn.Close()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) serveUDP(conn net.PacketConn) {
+	defer s.wg.Done()
+	buf := make([]byte, dnsMaxSizeUDP)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closeCh:
+				return
+			default:
+				continue
+			}
+		}
+		payload := make([]byte, n)
+		copy(payload, buf[:n])
+		go func(payload []byte, addr net.Addr) {
+			reply := s.handleQuery(payload, conn.LocalAddr(), addr)
+			if reply != nil {
+				conn.WriteTo(reply, addr)
+			}
+		}(payload, addr)
+	}
+}
+
+func (s *Server) serveTCP(ln net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.closeCh:
+				return
+			default:
+				continue
+			}
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+func (s *Server) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var lengthPrefix [2]byte
+		if _, err := io.ReadFull(conn, lengthPrefix[:]); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(lengthPrefix[:]))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+
+		reply := s.handleQuery(payload, conn.LocalAddr(), conn.RemoteAddr())
+		if reply == nil {
+			continue
+		}
+		binary.BigEndian.PutUint16(lengthPrefix[:], uint16(len(reply)))
+		if _, err := conn.Write(lengthPrefix[:]); err != nil {
+			return
+		}
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// handleQuery answers either a plain DNS TXT query for the certificate, or a
+// DNSCrypt-encrypted query, returning the bytes to send back, or nil to drop
+// the query.
+func (s *Server) handleQuery(payload []byte, local, remote net.Addr) []byte {
+	if reply := s.answerCertTXT(payload); reply != nil {
+		return reply
+	}
+	return s.answerEncryptedQuery(payload, local, remote)
+}
+
+// answerCertTXT serves the current certificate as a TXT record, if payload
+// is a plain DNS query for ProviderName.
+func (s *Server) answerCertTXT(payload []byte) []byte {
+	query := new(dns.Msg)
+	if err := query.Unpack(payload); err != nil {
+		return nil
+	}
+	if len(query.Question) != 1 {
+		return nil
+	}
+	q := query.Question[0]
+	if q.Qtype != dns.TypeTXT || !strings.EqualFold(q.Name, dns.Fqdn(s.ProviderName)) {
+		return nil
+	}
+
+	entry := s.currentEntry()
+	if entry == nil {
+		return nil
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(query)
+	reply.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{string(packTXT(entry.wireCert))},
+	}}
+	out, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// answerEncryptedQuery decrypts a DNSCrypt query, dispatches it to Handler,
+// and returns the encrypted, padded reply.
+func (s *Server) answerEncryptedQuery(payload []byte, local, remote net.Addr) []byte {
+	const headerLen = 8 + 32 + 12 // ClientMagic + ClientPublicKey + ClientNonce
+	if len(payload) <= headerLen {
+		return nil
+	}
+
+	var queryHeader dnsCryptQueryHeader
+	if err := binary.Read(bytes.NewReader(payload[:headerLen]), binary.BigEndian, &queryHeader); err != nil {
+		return nil
+	}
+	entry, ok := s.entryForMagic(queryHeader.ClientMagic)
+	if !ok {
+		return nil
+	}
+
+	var queryNonce [24]byte
+	copy(queryNonce[:12], queryHeader.ClientNonce[:])
+	plaintext, err := open(entry.fields.Construction, payload[headerLen:], &queryNonce, &queryHeader.ClientPublicKey, &entry.secretKey)
+	if err != nil {
+		return nil
+	}
+	plaintext, err = removePadding(plaintext)
+	if err != nil {
+		return nil
+	}
+
+	q := new(dns.Msg)
+	if err := q.Unpack(plaintext); err != nil {
+		return nil
+	}
+
+	var reply []byte
+	w := &dnsCryptResponseWriter{
+		localAddr:   local,
+		remoteAddr:  remote,
+		queryHeader: queryHeader,
+		entry:       entry,
+		send:        func(b []byte) { reply = b },
+	}
+	s.Handler.ServeDNS(w, q)
+	return reply
+}
+
+// dnsCryptResponseWriter implements dns.ResponseWriter so an ordinary
+// dns.Handler can answer a DNSCrypt query without knowing anything about
+// encryption or transport framing; WriteMsg seals and pads the reply, and
+// hands the resulting bytes to send.
+type dnsCryptResponseWriter struct {
+	localAddr, remoteAddr net.Addr
+	queryHeader           dnsCryptQueryHeader
+	entry                 *certEntry
+	send                  func([]byte)
+}
+
+func (w *dnsCryptResponseWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.PackBuffer(nil)
+	if err != nil {
+		return err
+	}
+	padded, err := addPadding(packed)
+	if err != nil {
+		return err
+	}
+
+	var serverNonce [12]byte
+	if _, err := rand.Read(serverNonce[:]); err != nil {
+		return err
+	}
+	var nonce [24]byte
+	copy(nonce[:12], w.queryHeader.ClientNonce[:])
+	copy(nonce[12:], serverNonce[:])
+
+	ciphertext, err := seal(w.entry.fields.Construction, padded, &nonce, &w.queryHeader.ClientPublicKey, &w.entry.secretKey)
+	if err != nil {
+		return err
+	}
+
+	responseHeader := dnsCryptResponseHeader{
+		ServerMagic: resolverMagic,
+		ClientNonce: w.queryHeader.ClientNonce,
+		ServerNonce: serverNonce,
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, responseHeader)
+	buf.Write(ciphertext)
+
+	w.send(buf.Bytes())
+	return nil
+}
+
+func (w *dnsCryptResponseWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("dnscrypt: ResponseWriter.Write is not supported, use WriteMsg")
+}
+
+func (w *dnsCryptResponseWriter) Close() error         { return nil }
+func (w *dnsCryptResponseWriter) LocalAddr() net.Addr  { return w.localAddr }
+func (w *dnsCryptResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+func (w *dnsCryptResponseWriter) TsigStatus() error    { return nil }
+func (w *dnsCryptResponseWriter) TsigTimersOnly(bool)  {}
+func (w *dnsCryptResponseWriter) Hijack()              {}
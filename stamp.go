@@ -0,0 +1,164 @@
+package dnscrypt
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Stamp protocol identifiers, as defined by
+// https://dnscrypt.info/stamps-specifications.
+const (
+	stampProtoDNSCrypt      = 0x01
+	stampProtoDNSCryptRelay = 0x81
+)
+
+// Stamp represents a parsed "sdns://" DNS stamp for a DNSCrypt resolver.
+type Stamp struct {
+	Props        uint64
+	ServerAddr   string
+	ServerPk     [32]byte
+	ProviderName string
+}
+
+// NewStampFromString parses a DNSCrypt "sdns://" stamp URI (protocol 0x01)
+// into its constituent fields.
+func NewStampFromString(stampStr string) (Stamp, error) {
+	if !strings.HasPrefix(stampStr, "sdns://") {
+		return Stamp{}, errors.New("Stamp is missing the sdns:// prefix")
+	}
+
+	bin, err := base64.RawURLEncoding.DecodeString(stampStr[len("sdns://"):])
+	if err != nil {
+		return Stamp{}, err
+	}
+
+	if len(bin) < 1 {
+		return Stamp{}, errors.New("Stamp is too short")
+	}
+	if bin[0] != stampProtoDNSCrypt {
+		return Stamp{}, errors.New("Unsupported stamp protocol")
+	}
+	bin = bin[1:]
+
+	if len(bin) < 8 {
+		return Stamp{}, errors.New("Stamp is missing the properties field")
+	}
+	props := binary.LittleEndian.Uint64(bin[:8])
+	bin = bin[8:]
+
+	addr, bin, err := readStampLP(bin)
+	if err != nil {
+		return Stamp{}, err
+	}
+	serverAddr := addDefaultPort(string(addr), "443")
+
+	pk, bin, err := readStampLP(bin)
+	if err != nil {
+		return Stamp{}, err
+	}
+	if len(pk) != 32 {
+		return Stamp{}, errors.New("Stamp provider public key is not 32 bytes")
+	}
+
+	providerName, _, err := readStampLP(bin)
+	if err != nil {
+		return Stamp{}, err
+	}
+
+	stamp := Stamp{
+		Props:        props,
+		ServerAddr:   serverAddr,
+		ProviderName: string(providerName),
+	}
+	copy(stamp.ServerPk[:], pk)
+	return stamp, nil
+}
+
+// String encodes the stamp back into its "sdns://" representation.
+func (s Stamp) String() (string, error) {
+	bin := []byte{stampProtoDNSCrypt}
+	bin = binary.LittleEndian.AppendUint64(bin, s.Props)
+	bin = appendStampLP(bin, []byte(s.ServerAddr))
+	bin = appendStampLP(bin, s.ServerPk[:])
+	bin = appendStampLP(bin, []byte(s.ProviderName))
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(bin), nil
+}
+
+// NewRelayStampFromString parses an Anonymized DNSCrypt relay "sdns://" stamp
+// URI (protocol 0x81) into the relay's address. Relay stamps carry no
+// properties, provider key, or provider name — just the address to forward
+// relayed queries to.
+func NewRelayStampFromString(stampStr string) (string, error) {
+	if !strings.HasPrefix(stampStr, "sdns://") {
+		return "", errors.New("Stamp is missing the sdns:// prefix")
+	}
+
+	bin, err := base64.RawURLEncoding.DecodeString(stampStr[len("sdns://"):])
+	if err != nil {
+		return "", err
+	}
+
+	if len(bin) < 1 {
+		return "", errors.New("Stamp is too short")
+	}
+	if bin[0] != stampProtoDNSCryptRelay {
+		return "", errors.New("Unsupported relay stamp protocol")
+	}
+	bin = bin[1:]
+
+	addr, _, err := readStampLP(bin)
+	if err != nil {
+		return "", err
+	}
+	return addDefaultPort(string(addr), "443"), nil
+}
+
+// addDefaultPort appends defaultPort to addr if addr doesn't already carry a
+// port. Unlike relying solely on net.SplitHostPort's error, this handles a
+// bracketed IPv6 literal with no port (e.g. "[2001:db8::1]") explicitly —
+// net.JoinHostPort would otherwise double-bracket it, since SplitHostPort
+// also errors on that form.
+func addDefaultPort(addr, defaultPort string) string {
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		return net.JoinHostPort(addr[1:len(addr)-1], defaultPort)
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, defaultPort)
+}
+
+// readStampLP reads a single length-prefixed ("LP") field as used by the DNS
+// stamp format: one length byte followed by that many bytes. It returns the
+// field and the remaining, unconsumed bytes.
+func readStampLP(bin []byte) ([]byte, []byte, error) {
+	if len(bin) < 1 {
+		return nil, nil, errors.New("Stamp is missing a length-prefixed field")
+	}
+	length := int(bin[0])
+	bin = bin[1:]
+	if len(bin) < length {
+		return nil, nil, errors.New("Stamp length-prefixed field is truncated")
+	}
+	return bin[:length], bin[length:], nil
+}
+
+// appendStampLP appends a length-prefixed ("LP") field to bin.
+func appendStampLP(bin []byte, field []byte) []byte {
+	bin = append(bin, byte(len(field)))
+	return append(bin, field...)
+}
+
+// GetValidCertFromStamp parses a DNSCrypt stamp and retrieves the resolver's
+// certificate in one call, equivalent to NewStampFromString followed by
+// GetValidCert.
+func GetValidCertFromStamp(stampStr string) (SignedBincertFields, error) {
+	stamp, err := NewStampFromString(stampStr)
+	if err != nil {
+		return SignedBincertFields{}, err
+	}
+	return GetValidCert(stamp.ServerAddr, stamp.ProviderName, stamp.ServerPk[:])
+}
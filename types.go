@@ -1,5 +1,16 @@
 package dnscrypt
 
+// CryptoConstruction identifies the AEAD construction a certificate negotiates,
+// i.e. the value carried in signedBincert.VersionMajor.
+type CryptoConstruction uint16
+
+const (
+	// XSalsa20Poly1305 is es-version 0x0001: X25519-XSalsa20Poly1305 (nacl/box).
+	XSalsa20Poly1305 CryptoConstruction = 0x0001
+	// XChacha20Poly1305 is es-version 0x0002: X25519-XChacha20Poly1305.
+	XChacha20Poly1305 CryptoConstruction = 0x0002
+)
+
 // SignedBincertFields Represents the detailed structure of a DNSC certificate
 type SignedBincertFields struct {
 	ServerPublicKey [32]byte
@@ -7,6 +18,20 @@ type SignedBincertFields struct {
 	Serial          [4]byte
 	TSBegin         uint32
 	TSEnd           uint32
+	// Construction is the negotiated AEAD construction for this certificate,
+	// taken from the enclosing signedBincert.VersionMajor rather than from
+	// the signed data itself.
+	Construction CryptoConstruction
+}
+
+// signedBincertFieldsWire mirrors the on-the-wire layout of SignedBincertFields'
+// signed data, i.e. everything except the out-of-band Construction field.
+type signedBincertFieldsWire struct {
+	ServerPublicKey [32]byte
+	MagicQuery      [8]byte
+	Serial          [4]byte
+	TSBegin         uint32
+	TSEnd           uint32
 }
 
 // SignedBincert Represents the structure of a DNSC certificate as needed to verify the signature